@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
 	"flag"
@@ -12,7 +13,10 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/stevemurr/z/z-web/internal/agent"
+	"github.com/stevemurr/z/z-web/internal/discovery"
 	"github.com/stevemurr/z/z-web/internal/server"
 )
 
@@ -22,20 +26,59 @@ var staticFiles embed.FS
 func main() {
 	port := flag.Int("port", 7680, "Port to listen on")
 	host := flag.String("host", "tailscale", "Host to bind to (tailscale, localhost, or IP)")
+	enableAgent := flag.Bool("enable-agent", false, "Enable the /z-agent/ test-automation endpoints (off by default)")
+	peerRefresh := flag.Duration("peer-refresh", 30*time.Second, "How often to refresh the tailnet peer roster")
+	noTmux := flag.Bool("no-tmux", false, "Disable tmux integration and only serve the local shell session (for machines without tmux installed)")
 	flag.Parse()
 
+	// In Tailscale mode, provision certs up front for HTTPS serving.
+	var hostname, certFile, keyFile string
+	if *host != "localhost" {
+		var err error
+		hostname, certFile, keyFile, err = setupTailscaleCerts()
+		if err != nil {
+			log.Fatal("Failed to setup Tailscale certs: ", err)
+		}
+	}
+
+	// Discover peers in the tailnet (the z-beacon successor). Disabled
+	// in localhost mode, where there's no tailnet to browse.
+	var disc *discovery.Discoverer
+	if *host != "localhost" {
+		disc = discovery.New()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go disc.Run(ctx, *peerRefresh)
+	}
+
 	// Create server
-	srv := server.New()
+	srv := server.New(disc, *port, *noTmux)
 
 	// Set up routes
 	mux := http.NewServeMux()
 
-	// WebSocket endpoint
+	// WebSocket endpoints
 	mux.HandleFunc("/ws", srv.HandleWebSocket)
+	mux.HandleFunc("/ws/proxy", srv.HandleProxyWebSocket)
 
 	// API endpoints
 	mux.HandleFunc("/api/sessions", srv.HandleSessions)
 	mux.HandleFunc("/api/sessions/create", srv.HandleCreateSession)
+	mux.HandleFunc("/api/peers", srv.HandlePeers)
+	mux.HandleFunc("/api/recordings", srv.HandleRecordings)
+	mux.HandleFunc("/api/recordings/", srv.HandleRecording)
+
+	// Test-agent endpoints for driving z-web headlessly in integration
+	// tests. Off by default since it can run arbitrary commands.
+	if *enableAgent {
+		token := os.Getenv("Z_AGENT_TOKEN")
+		if token == "" {
+			log.Fatal("--enable-agent requires the Z_AGENT_TOKEN environment variable to be set")
+		}
+		agentHandler := agent.New(token)
+		mux.Handle("/z-agent/", http.StripPrefix("/z-agent", agentHandler.Mux()))
+		fmt.Println("z-agent endpoints enabled at /z-agent/")
+	}
 
 	// Static files (frontend)
 	staticFS, err := fs.Sub(staticFiles, "dist")
@@ -58,11 +101,6 @@ func main() {
 		}
 	} else {
 		// Tailscale mode - HTTPS required
-		hostname, certFile, keyFile, err := setupTailscaleCerts()
-		if err != nil {
-			log.Fatal("Failed to setup Tailscale certs: ", err)
-		}
-
 		addr := fmt.Sprintf(":%d", *port)
 		fmt.Printf("z-web server starting (HTTPS mode)...\n")
 		fmt.Printf("  URL: https://%s:%d\n", hostname, *port)
@@ -0,0 +1,233 @@
+// Package agent exposes HTTP endpoints for driving z-web headlessly
+// during integration tests, modeled on Tailscale's tta test agent. It is
+// mounted under /z-agent/ only when explicitly enabled, since it can run
+// arbitrary commands and inject keystrokes into any z- tmux session.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stevemurr/z/z-web/internal/session"
+)
+
+const (
+	execTimeout      = 30 * time.Second
+	defaultLines     = 2000
+	defaultTimeout   = 10 * time.Second
+	waitPollInterval = 200 * time.Millisecond
+)
+
+// Handler serves the /z-agent/ test-automation routes.
+type Handler struct {
+	token string
+}
+
+// New creates an agent Handler that requires every request to carry
+// token as a bearer token.
+func New(token string) *Handler {
+	return &Handler{token: token}
+}
+
+// Mux returns the agent's routes. Mount it under /z-agent/ with
+// http.StripPrefix("/z-agent", handler.Mux()).
+func (h *Handler) Mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/exec", h.withAuth(h.handleExec))
+	mux.HandleFunc("/send-keys", h.withAuth(h.handleSendKeys))
+	mux.HandleFunc("/capture", h.withAuth(h.handleCapture))
+	mux.HandleFunc("/wait-for", h.withAuth(h.handleWaitFor))
+	return mux
+}
+
+// withAuth rejects requests that don't carry the configured bearer token.
+func (h *Handler) withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if h.token == "" || got != h.token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleExec runs an arbitrary shell command and reports its combined
+// stdout/stderr as the response body and exit code via X-Exit-Code.
+func (h *Handler) handleExec(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	command := strings.TrimSpace(string(body))
+	if command == "" {
+		http.Error(w, "empty command", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), execTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	exitCode := 0
+	if runErr := cmd.Run(); runErr != nil {
+		exitErr, ok := runErr.(*exec.ExitError)
+		if !ok {
+			http.Error(w, fmt.Sprintf("failed to run command: %v", runErr), http.StatusInternalServerError)
+			return
+		}
+		exitCode = exitErr.ExitCode()
+	}
+
+	w.Header().Set("X-Exit-Code", strconv.Itoa(exitCode))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+// handleSendKeys injects keystrokes into a tmux pane via `tmux send-keys`.
+// The request body is sent literally; pass ?enter=true to also send an
+// Enter keypress afterward.
+func (h *Handler) handleSendKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionName := r.URL.Query().Get("session")
+	if sessionName == "" {
+		http.Error(w, "missing session parameter", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	target := session.SessionPrefix + sessionName
+
+	// -l sends the body literally; without it tmux interprets text that
+	// happens to match a key name (e.g. "Enter", "C-c") as that keypress
+	// instead of typing it. Enter, when requested, is sent as its own
+	// command so -l doesn't also swallow it as literal text.
+	if err := exec.Command("tmux", "send-keys", "-t", target, "-l", string(body)).Run(); err != nil {
+		http.Error(w, fmt.Sprintf("send-keys failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("enter") == "true" {
+		if err := exec.Command("tmux", "send-keys", "-t", target, "Enter").Run(); err != nil {
+			http.Error(w, fmt.Sprintf("send-keys failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCapture returns a plain-text snapshot of a tmux pane.
+func (h *Handler) handleCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionName := r.URL.Query().Get("session")
+	if sessionName == "" {
+		http.Error(w, "missing session parameter", http.StatusBadRequest)
+		return
+	}
+
+	lines := defaultLines
+	if v := r.URL.Query().Get("lines"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			lines = n
+		}
+	}
+
+	out, err := capturePane(sessionName, lines)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out)
+}
+
+// handleWaitFor polls a tmux pane until its contents match regex or
+// timeout elapses.
+func (h *Handler) handleWaitFor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionName := r.URL.Query().Get("session")
+	pattern := r.URL.Query().Get("regex")
+	if sessionName == "" || pattern == "" {
+		http.Error(w, "missing session or regex parameter", http.StatusBadRequest)
+		return
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid regex: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	timeout := defaultTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			timeout = d
+		} else if secs, err := strconv.Atoi(v); err == nil {
+			timeout = time.Duration(secs) * time.Second
+		}
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		out, err := capturePane(sessionName, defaultLines)
+		if err == nil && re.Match(out) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write(out)
+			return
+		}
+		if time.Now().After(deadline) {
+			http.Error(w, fmt.Sprintf("timed out after %s waiting for %q", timeout, pattern), http.StatusGatewayTimeout)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(waitPollInterval):
+		}
+	}
+}
+
+// capturePane returns the last `lines` of a tmux pane's history.
+func capturePane(sessionName string, lines int) ([]byte, error) {
+	cmd := exec.Command("tmux", "capture-pane", "-t", session.SessionPrefix+sessionName, "-p", "-S", fmt.Sprintf("-%d", lines))
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("capture-pane failed: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,204 @@
+// Package discovery turns the standalone z-beacon binary into a
+// first-class discovery client inside z-web: it periodically walks
+// `tailscale status --json`, probes every online peer's /z-beacon
+// endpoint, and caches the results for the /api/peers route and the
+// "peers" ws message.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stevemurr/z/z-web/internal/ws"
+)
+
+const (
+	// beaconPort is the port z-beacon listens on by default.
+	beaconPort = 7681
+
+	probeTimeout = 2 * time.Second
+	minBackoff   = 5 * time.Second
+	maxBackoff   = 5 * time.Minute
+)
+
+// beaconResponse mirrors the payload served by z-beacon's /z-beacon
+// endpoint on each peer.
+type beaconResponse struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	TailscaleIP string `json:"tailscale_ip"`
+}
+
+// backoffState tracks a host that failed its last probe, so refresh
+// cycles don't hammer machines that are offline or unreachable.
+type backoffState struct {
+	nextAttempt time.Time
+	delay       time.Duration
+}
+
+// Discoverer periodically probes every online tailnet peer for a
+// z-beacon response and caches the results.
+type Discoverer struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	peers   map[string]ws.Peer // keyed by Tailscale IP
+	backoff map[string]*backoffState
+}
+
+// New creates a Discoverer. Call Run in a goroutine to start refreshing.
+func New() *Discoverer {
+	return &Discoverer{
+		client:  &http.Client{Timeout: probeTimeout},
+		peers:   make(map[string]ws.Peer),
+		backoff: make(map[string]*backoffState),
+	}
+}
+
+// Run refreshes the peer cache every interval until ctx is canceled.
+func (d *Discoverer) Run(ctx context.Context, interval time.Duration) {
+	d.refresh()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.refresh()
+		}
+	}
+}
+
+// Peers returns the currently known peers, sorted by name.
+func (d *Discoverer) Peers() []ws.Peer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	out := make([]ws.Peer, 0, len(d.peers))
+	for _, p := range d.peers {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// refresh walks the tailnet peer list and probes every host that isn't
+// currently backing off, in parallel.
+func (d *Discoverer) refresh() {
+	ips, err := tailscalePeerIPs()
+	if err != nil {
+		log.Printf("discovery: tailscale status failed: %v", err)
+		return
+	}
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	for _, ip := range ips {
+		d.mu.Lock()
+		b, backingOff := d.backoff[ip]
+		d.mu.Unlock()
+		if backingOff && now.Before(b.nextAttempt) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			d.probe(ip)
+		}(ip)
+	}
+	wg.Wait()
+}
+
+// probe issues GET /z-beacon against a peer's Tailscale IP and updates
+// the cache and backoff state accordingly.
+func (d *Discoverer) probe(ip string) {
+	url := fmt.Sprintf("http://%s:%d/z-beacon", ip, beaconPort)
+	resp, err := d.client.Get(url)
+	if err != nil {
+		d.recordFailure(ip)
+		return
+	}
+	defer resp.Body.Close()
+
+	var beacon beaconResponse
+	if err := json.NewDecoder(resp.Body).Decode(&beacon); err != nil {
+		d.recordFailure(ip)
+		return
+	}
+
+	d.mu.Lock()
+	d.peers[ip] = ws.Peer{
+		Name:        beacon.Name,
+		Version:     beacon.Version,
+		TailscaleIP: beacon.TailscaleIP,
+		LastSeen:    time.Now().Unix(),
+	}
+	delete(d.backoff, ip)
+	d.mu.Unlock()
+}
+
+// recordFailure drops ip from the cache and schedules its next retry
+// with exponential backoff, capped at maxBackoff.
+func (d *Discoverer) recordFailure(ip string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.peers, ip)
+
+	b, ok := d.backoff[ip]
+	if !ok {
+		b = &backoffState{delay: minBackoff}
+	} else {
+		b.delay *= 2
+		if b.delay > maxBackoff {
+			b.delay = maxBackoff
+		}
+	}
+	b.nextAttempt = time.Now().Add(b.delay)
+	d.backoff[ip] = b
+}
+
+// tailscalePeerIPs returns the Tailscale IPv4 address of every online
+// peer in the tailnet.
+func tailscalePeerIPs() ([]string, error) {
+	output, err := exec.Command("tailscale", "status", "--json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("tailscale status: %w", err)
+	}
+
+	var status struct {
+		Peer map[string]struct {
+			Online       bool     `json:"Online"`
+			TailscaleIPs []string `json:"TailscaleIPs"`
+		} `json:"Peer"`
+	}
+	if err := json.Unmarshal(output, &status); err != nil {
+		return nil, fmt.Errorf("parse tailscale status: %w", err)
+	}
+
+	var ips []string
+	for _, peer := range status.Peer {
+		if !peer.Online {
+			continue
+		}
+		for _, ip := range peer.TailscaleIPs {
+			if strings.Contains(ip, ":") {
+				continue // skip IPv6; z-beacon binds its IPv4 address
+			}
+			ips = append(ips, ip)
+			break
+		}
+	}
+	return ips, nil
+}
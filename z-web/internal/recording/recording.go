@@ -0,0 +1,304 @@
+// Package recording tees PTY output into asciinema v2 recordings
+// (https://docs.asciinema.org/manual/asciicast/v2/) and reads them back
+// for the /api/recordings listing, raw download, and WS playback routes.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stevemurr/z/z-web/internal/ws"
+)
+
+// dirName is where casts are kept, relative to the user's home directory.
+const dirName = ".z/recordings"
+
+// Header is the first line of an asciicast v2 file.
+type Header struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"` // z-web session name, for List
+}
+
+// Event is one asciicast v2 event line: [elapsed-seconds, type, data].
+// Type is "o" for output or "r" for a resize ("COLSxROWS" in Data).
+type Event struct {
+	Elapsed float64
+	Type    string
+	Data    string
+}
+
+// MarshalJSON encodes an Event as the 3-element array asciicast expects.
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal([3]interface{}{e.Elapsed, e.Type, e.Data})
+}
+
+// UnmarshalJSON decodes an Event from its 3-element array form.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var raw [3]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw[0], &e.Elapsed); err != nil {
+		return fmt.Errorf("decode event elapsed: %w", err)
+	}
+	if err := json.Unmarshal(raw[1], &e.Type); err != nil {
+		return fmt.Errorf("decode event type: %w", err)
+	}
+	return json.Unmarshal(raw[2], &e.Data)
+}
+
+// Recorder tees a single session's PTY output to an asciicast v2 file on
+// disk. It is safe for concurrent use, since a hub's broadcast and resize
+// paths both write to it.
+type Recorder struct {
+	id string
+
+	mu    sync.Mutex
+	f     *os.File
+	enc   *json.Encoder
+	start time.Time
+}
+
+// New starts a recording for sessionName, creating ~/.z/recordings if
+// needed. The returned Recorder's ID is derived from the file it wrote,
+// in the form "<sessionName>-<unix-start-time>".
+func New(sessionName string, cols, rows uint16) (*Recorder, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create recordings dir: %w", err)
+	}
+
+	now := time.Now()
+	id := fmt.Sprintf("%s-%d", sessionName, now.Unix())
+	f, err := os.Create(filepath.Join(dir, id+".cast"))
+	if err != nil {
+		return nil, fmt.Errorf("create recording file: %w", err)
+	}
+
+	header := Header{
+		Version:   2,
+		Width:     int(cols),
+		Height:    int(rows),
+		Timestamp: now.Unix(),
+		Title:     sessionName,
+	}
+	enc := json.NewEncoder(f)
+	if err := enc.Encode(header); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("write recording header: %w", err)
+	}
+
+	return &Recorder{id: id, f: f, enc: enc, start: now}, nil
+}
+
+// ID returns the recording's filename, without the .cast extension.
+func (r *Recorder) ID() string {
+	return r.id
+}
+
+// WriteOutput appends a PTY output event.
+func (r *Recorder) WriteOutput(data []byte) {
+	r.writeEvent(Event{Type: "o", Data: string(data)})
+}
+
+// WriteResize appends a terminal resize event.
+func (r *Recorder) WriteResize(cols, rows uint16) {
+	r.writeEvent(Event{Type: "r", Data: fmt.Sprintf("%dx%d", cols, rows)})
+}
+
+// ParseSize parses a "r" event's Data field ("COLSxROWS", as written by
+// WriteResize) back into its dimensions.
+func ParseSize(data string) (cols, rows uint16, err error) {
+	var c, rw int
+	if _, err := fmt.Sscanf(data, "%dx%d", &c, &rw); err != nil {
+		return 0, 0, fmt.Errorf("parse resize event %q: %w", data, err)
+	}
+	return uint16(c), uint16(rw), nil
+}
+
+func (r *Recorder) writeEvent(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e.Elapsed = time.Since(r.start).Seconds()
+	if err := r.enc.Encode(e); err != nil {
+		// A failed recording write shouldn't interrupt the session; the
+		// cast just ends up truncated.
+		return
+	}
+}
+
+// Close stops the recording and closes the underlying file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// Dir returns ~/.z/recordings.
+func Dir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, dirName), nil
+}
+
+// validID matches the IDs New generates ("<sessionName>-<unix-time>")
+// for session names made only of letters, digits and "_.-$" (which
+// covers the local shell session, "$local").
+// ValidID and Path reject anything else, since id comes straight from
+// the URL path in HandleRecording and is otherwise joined directly into
+// a filesystem path: without this, a crafted id (e.g. containing "..")
+// could read any file on disk that happens to end in ".cast".
+var validID = regexp.MustCompile(`^[A-Za-z0-9_.$-]+$`)
+
+// ValidID reports whether id is safe to use as a recording filename
+// component. Callers taking id from a request path should check this
+// before passing it to Path, ReadEvents, or anything else that touches
+// disk with it.
+func ValidID(id string) bool {
+	return validID.MatchString(id)
+}
+
+// Path returns the on-disk path of the cast file for id, performing no
+// existence check. It rejects any id that isn't a plain filename
+// component (see ValidID).
+func Path(id string) (string, error) {
+	if !ValidID(id) {
+		return "", fmt.Errorf("invalid recording id %q", id)
+	}
+
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, id+".cast"), nil
+}
+
+// List returns every recording in Dir, most recent first.
+func List() ([]ws.Recording, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []ws.Recording{}, nil
+		}
+		return nil, fmt.Errorf("read recordings dir: %w", err)
+	}
+
+	var out []ws.Recording
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".cast") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".cast")
+
+		meta, err := readMeta(filepath.Join(dir, entry.Name()), id)
+		if err != nil {
+			continue // skip unreadable/corrupt casts rather than failing the whole list
+		}
+		out = append(out, meta)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt > out[j].StartedAt })
+	return out, nil
+}
+
+// readMeta parses a cast file's header and final event to build its
+// list-view metadata.
+func readMeta(path, id string) (ws.Recording, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ws.Recording{}, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return ws.Recording{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	if !scanner.Scan() {
+		return ws.Recording{}, fmt.Errorf("empty cast file")
+	}
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return ws.Recording{}, fmt.Errorf("parse cast header: %w", err)
+	}
+
+	var lastElapsed float64
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err == nil {
+			lastElapsed = e.Elapsed
+		}
+	}
+
+	return ws.Recording{
+		ID:        id,
+		Session:   header.Title,
+		StartedAt: header.Timestamp,
+		Duration:  lastElapsed,
+		Size:      info.Size(),
+	}, nil
+}
+
+// ReadEvents parses a cast file into its header and ordered events, for
+// WS playback.
+func ReadEvents(id string) (Header, []Event, error) {
+	path, err := Path(id)
+	if err != nil {
+		return Header{}, nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	if !scanner.Scan() {
+		return Header{}, nil, fmt.Errorf("empty cast file")
+	}
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return Header{}, nil, fmt.Errorf("parse cast header: %w", err)
+	}
+
+	var events []Event
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+
+	return header, events, nil
+}
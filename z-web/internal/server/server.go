@@ -1,22 +1,27 @@
 package server
 
 import (
+	"encoding/binary"
 	"encoding/json"
-	"io"
+	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"os/exec"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/stevemurr/z/z-web/internal/discovery"
+	"github.com/stevemurr/z/z-web/internal/recording"
 	"github.com/stevemurr/z/z-web/internal/session"
 	"github.com/stevemurr/z/z-web/internal/ws"
 )
 
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	ReadBufferSize:    1024,
+	WriteBufferSize:   64 * 1024, // PTY output frames can be up to batchMaxBytes; avoid re-allocating per write
+	EnableCompression: true,
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins (Tailscale provides security)
 	},
@@ -25,12 +30,81 @@ var upgrader = websocket.Upgrader{
 // Server handles HTTP and WebSocket connections
 type Server struct {
 	sessions *session.Manager
+	peers    *discovery.Discoverer // nil if peer discovery is disabled (e.g. localhost mode)
+	peerPort int
+
+	mu      sync.Mutex
+	clients map[string]map[*Client]struct{} // session name -> attached clients, for roster broadcasts
 }
 
-// New creates a new server
-func New() *Server {
+// New creates a new server. peers may be nil to disable the peer picker
+// and proxy (e.g. in localhost mode, where there's no tailnet to browse).
+// peerPort is the port every z-web instance in the tailnet listens on.
+// Access control for the peer proxy, same as every other route, is
+// Tailscale's network-level ACLs (see CheckOrigin above) rather than
+// anything at the TLS layer: a peer's listener serves ordinary browser
+// traffic and this proxy traffic on the same port, so it has no way to
+// require or verify a client certificate from us.
+func New(peers *discovery.Discoverer, peerPort int, noTmux bool) *Server {
 	return &Server{
-		sessions: session.NewManager(),
+		sessions: session.NewManager(noTmux),
+		peers:    peers,
+		peerPort: peerPort,
+		clients:  make(map[string]map[*Client]struct{}),
+	}
+}
+
+var clientSeq atomic.Uint64
+
+// newClientID assigns each WebSocket connection a short id used to track
+// driver/follower state in session.Manager.
+func newClientID() string {
+	return fmt.Sprintf("c%d", clientSeq.Add(1))
+}
+
+// trackClient records that c is attached to sessionName, so role changes
+// can be broadcast to every client sharing that session.
+func (s *Server) trackClient(sessionName string, c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[sessionName] == nil {
+		s.clients[sessionName] = make(map[*Client]struct{})
+	}
+	s.clients[sessionName][c] = struct{}{}
+}
+
+// untrackClient reverses trackClient.
+func (s *Server) untrackClient(sessionName string, c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients[sessionName], c)
+	if len(s.clients[sessionName]) == 0 {
+		delete(s.clients, sessionName)
+	}
+}
+
+// broadcastRole notifies every client attached to sessionName of the
+// current roster, so followers see driver changes (e.g. after
+// takeControl) without polling the session list.
+func (s *Server) broadcastRole(sessionName string, roster []ws.ClientRole) {
+	s.mu.Lock()
+	peers := make([]*Client, 0, len(s.clients[sessionName]))
+	for c := range s.clients[sessionName] {
+		peers = append(peers, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range peers {
+		_, sub := c.attached()
+		if sub == nil {
+			continue
+		}
+		c.sendJSON(ws.ServerMessage{
+			Type:    ws.MsgTypeRole,
+			Session: sessionName,
+			Role:    string(sub.Role()),
+			Roster:  roster,
+		})
 	}
 }
 
@@ -51,6 +125,196 @@ func (s *Server) HandleSessions(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(sessions)
 }
 
+// HandlePeers handles GET /api/peers, returning the tailnet peers
+// discovery has found so far. Returns an empty list if peer discovery
+// is disabled.
+func (s *Server) HandlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var peers []ws.Peer
+	if s.peers != nil {
+		peers = s.peers.Peers()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peers)
+}
+
+// HandleRecordings handles GET /api/recordings, listing every asciinema
+// recording on disk, most recent first.
+func (s *Server) HandleRecordings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	recordings, err := recording.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recordings)
+}
+
+// HandleRecording handles GET /api/recordings/{id}, streaming the raw
+// .cast file, and GET /api/recordings/{id}/play, which replays it over a
+// WebSocket with each event's original inter-event delay so the frontend
+// can feed it straight into the same xterm.js widget used for live
+// sessions.
+func (s *Server) HandleRecording(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/recordings/")
+	if id == "" {
+		http.Error(w, "missing recording id", http.StatusBadRequest)
+		return
+	}
+
+	if play := strings.TrimSuffix(id, "/play"); play != id {
+		id = play
+		if !recording.ValidID(id) {
+			http.Error(w, fmt.Sprintf("invalid recording id %q", id), http.StatusBadRequest)
+			return
+		}
+		s.playRecording(w, r, id)
+		return
+	}
+
+	if !recording.ValidID(id) {
+		http.Error(w, fmt.Sprintf("invalid recording id %q", id), http.StatusBadRequest)
+		return
+	}
+
+	path, err := recording.Path(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	http.ServeFile(w, r, path)
+}
+
+// playRecording streams a recording's events over a WebSocket, pacing
+// them by their original inter-event delay so playback matches the
+// original timing. Both output and resize events arrive as the same
+// binary frames live PTY output uses (ws.FrameOutput, ws.FrameResizeAck),
+// so the frontend can feed a recording into the same xterm.js widget and
+// resize logic it already has for live sessions.
+func (s *Server) playRecording(w http.ResponseWriter, r *http.Request, id string) {
+	header, events, err := recording.ReadEvents(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("recording playback WebSocket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	client := &Client{id: newClientID(), conn: conn, server: s}
+	client.sendJSON(ws.ServerMessage{
+		Type:    ws.MsgTypeAttached,
+		Session: header.Title,
+	})
+
+	var elapsed float64
+	for _, e := range events {
+		if delay := e.Elapsed - elapsed; delay > 0 {
+			time.Sleep(time.Duration(delay * float64(time.Second)))
+		}
+		elapsed = e.Elapsed
+
+		switch e.Type {
+		case "o":
+			client.sendOutput(0, []byte(e.Data))
+		case "r":
+			if cols, rows, err := recording.ParseSize(e.Data); err == nil {
+				client.sendResize(cols, rows)
+			}
+		}
+	}
+
+	client.sendFrame(ws.FrameExit)
+}
+
+// HandleProxyWebSocket proxies a browser's WebSocket connection through
+// to another z-web instance discovered in the tailnet (identified by
+// ?peer=<name>), so one browser tab can drive tmux sessions on any
+// machine discovery knows about.
+func (s *Server) HandleProxyWebSocket(w http.ResponseWriter, r *http.Request) {
+	peerName := r.URL.Query().Get("peer")
+	if peerName == "" {
+		http.Error(w, "missing peer parameter", http.StatusBadRequest)
+		return
+	}
+	if s.peers == nil {
+		http.Error(w, "peer discovery is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	var target ws.Peer
+	found := false
+	for _, p := range s.peers.Peers() {
+		if p.Name == peerName {
+			target = p
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("unknown peer %q", peerName), http.StatusNotFound)
+		return
+	}
+
+	clientConn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("proxy WebSocket upgrade error: %v", err)
+		return
+	}
+	defer clientConn.Close()
+
+	peerURL := fmt.Sprintf("wss://%s:%d/ws", target.TailscaleIP, s.peerPort)
+	peerConn, _, err := websocket.DefaultDialer.Dial(peerURL, nil)
+	if err != nil {
+		log.Printf("proxy dial to peer %q failed: %v", peerName, err)
+		clientConn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()))
+		return
+	}
+	defer peerConn.Close()
+
+	done := make(chan struct{}, 2)
+	go proxyPump(peerConn, clientConn, done)
+	go proxyPump(clientConn, peerConn, done)
+	<-done
+}
+
+// proxyPump copies WebSocket frames from src to dst until either side
+// closes or errors.
+func proxyPump(dst, src *websocket.Conn, done chan<- struct{}) {
+	defer func() { done <- struct{}{} }()
+	for {
+		msgType, data, err := src.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := dst.WriteMessage(msgType, data); err != nil {
+			return
+		}
+	}
+}
+
 // HandleWebSocket handles WebSocket connections
 func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -59,11 +323,12 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer conn.Close()
+	conn.EnableWriteCompression(true)
 
 	client := &Client{
-		conn:     conn,
-		server:   s,
-		writeMu:  sync.Mutex{},
+		id:     newClientID(),
+		conn:   conn,
+		server: s,
 	}
 
 	// Send initial session list
@@ -78,24 +343,95 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 // Client represents a WebSocket client
 type Client struct {
+	id      string
 	conn    *websocket.Conn
 	server  *Server
 	writeMu sync.Mutex
 
-	// Current attached session
+	// attachedSession and sub are written from the WS read-loop goroutine
+	// (handleAttach/handleDetach) and read from both that goroutine and
+	// the separate pumpOutput goroutine, plus any other client's
+	// broadcastRole call; attachMu guards both.
+	attachMu        sync.Mutex
 	attachedSession string
-	pty             *os.File
-	cmd             *exec.Cmd
-	stopChan        chan struct{}
+	sub             *session.Subscriber
+}
+
+// attached returns the client's current session name and subscriber.
+func (c *Client) attached() (sessionName string, sub *session.Subscriber) {
+	c.attachMu.Lock()
+	defer c.attachMu.Unlock()
+	return c.attachedSession, c.sub
+}
+
+// setAttached records that the client has joined sessionName's hub as sub.
+func (c *Client) setAttached(sessionName string, sub *session.Subscriber) {
+	c.attachMu.Lock()
+	defer c.attachMu.Unlock()
+	c.attachedSession = sessionName
+	c.sub = sub
+}
+
+// clearIfCurrent clears the client's attached session/subscriber, but
+// only if sub is still the one currently attached. It reports whether it
+// did. This guards pumpOutput against clobbering state after the client
+// has already detached and reattached elsewhere by the time its hub
+// subscriber channel closes.
+func (c *Client) clearIfCurrent(sub *session.Subscriber) bool {
+	c.attachMu.Lock()
+	defer c.attachMu.Unlock()
+	if c.sub != sub {
+		return false
+	}
+	c.sub = nil
+	c.attachedSession = ""
+	return true
 }
 
-// sendJSON sends a JSON message to the client
+// sendJSON sends a JSON message to the client. It's reserved for control
+// messages (attach, sessions, error, role, ...); PTY output goes over
+// sendOutput instead, to avoid base64/JSON overhead on the hot path.
 func (c *Client) sendJSON(msg ws.ServerMessage) error {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 	return c.conn.WriteJSON(msg)
 }
 
+// sendOutput writes a binary ws.FrameOutput frame: a 1-byte type prefix,
+// the 8-byte big-endian hub sequence number after data, then data itself.
+func (c *Client) sendOutput(seq int64, data []byte) error {
+	frame := make([]byte, 9+len(data))
+	frame[0] = ws.FrameOutput
+	binary.BigEndian.PutUint64(frame[1:9], uint64(seq))
+	copy(frame[9:], data)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// sendFrame writes a binary frame with no payload, e.g. FrameExit.
+func (c *Client) sendFrame(frameType byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.BinaryMessage, []byte{frameType})
+}
+
+// sendResize writes a binary ws.FrameResizeAck frame carrying the new
+// terminal size as two big-endian uint16s, so both a live resize ack and
+// a recording's replayed resize event can tell the client what size to
+// apply.
+func (c *Client) sendResize(cols, rows uint16) error {
+	frame := make([]byte, 5)
+	frame[0] = ws.FrameResizeAck
+	binary.BigEndian.PutUint16(frame[1:3], cols)
+	binary.BigEndian.PutUint16(frame[3:5], rows)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
 // sendSessionList sends the current session list to the client
 func (c *Client) sendSessionList() error {
 	sessions, err := c.server.sessions.List()
@@ -109,6 +445,19 @@ func (c *Client) sendSessionList() error {
 	})
 }
 
+// sendPeerList sends the current tailnet peer roster to the client.
+func (c *Client) sendPeerList() error {
+	var peers []ws.Peer
+	if c.server.peers != nil {
+		peers = c.server.peers.Peers()
+	}
+
+	return c.sendJSON(ws.ServerMessage{
+		Type:  ws.MsgTypePeers,
+		Peers: peers,
+	})
+}
+
 // readLoop reads messages from the WebSocket
 func (c *Client) readLoop() {
 	defer c.cleanup()
@@ -133,9 +482,12 @@ func (c *Client) handleMessage(msg ws.ClientMessage) {
 		c.sendSessionList()
 
 	case ws.MsgTypeAttach:
-		c.handleAttach(msg.Session, msg.Cols, msg.Rows)
+		c.handleAttach(msg.Session, msg.Cols, msg.Rows, true, msg.Seq, false)
 
-	case ws.MsgTypeDetach:
+	case ws.MsgTypeFollow:
+		c.handleAttach(msg.Session, msg.Cols, msg.Rows, false, msg.Seq, false)
+
+	case ws.MsgTypeDetach, ws.MsgTypeUnfollow:
 		c.handleDetach()
 
 	case ws.MsgTypeInput:
@@ -145,11 +497,17 @@ func (c *Client) handleMessage(msg ws.ClientMessage) {
 		c.handleResize(msg.Cols, msg.Rows)
 
 	case ws.MsgTypeCreate:
-		c.handleCreate(msg.Name)
+		c.handleCreate(msg.Name, msg.Record)
 
 	case ws.MsgTypeStop:
 		c.handleStop(msg.Session)
 
+	case ws.MsgTypeTakeControl:
+		c.handleTakeControl(msg.Session)
+
+	case ws.MsgTypePeers:
+		c.sendPeerList()
+
 	default:
 		c.sendJSON(ws.ServerMessage{
 			Type:    ws.MsgTypeError,
@@ -158,8 +516,19 @@ func (c *Client) handleMessage(msg ws.ClientMessage) {
 	}
 }
 
-// handleAttach attaches to a tmux session
-func (c *Client) handleAttach(sessionName string, cols, rows int) {
+// handleAttach joins the shared hub for a tmux session. preferDriver
+// requests the driver seat if nobody currently holds it; followers that
+// join via "follow" pass false and stay read-only until they TakeControl.
+//
+// resumeSeq lets a reconnecting client resume from the last output
+// sequence number it saw instead of replaying the full scrollback; pass
+// 0 for a fresh attach.
+//
+// record starts an asciinema recording of the session; it only has an
+// effect the first time the session's hub is created (see
+// session.Manager.Attach), so it's ignored on every attach but the one
+// that follows MsgTypeCreate with record:true.
+func (c *Client) handleAttach(sessionName string, cols, rows int, preferDriver bool, resumeSeq int64, record bool) {
 	// Detach from current session first
 	c.handleDetach()
 
@@ -171,8 +540,17 @@ func (c *Client) handleAttach(sessionName string, cols, rows int) {
 		rows = 24
 	}
 
-	// Attach to session
-	ptmx, cmd, err := c.server.sessions.Attach(sessionName, uint16(cols), uint16(rows))
+	// Join (or start) the session's hub. "$local" routes to a plain
+	// login shell instead of a tmux session, for machines without tmux.
+	var sub *session.Subscriber
+	var replay []byte
+	var seq int64
+	var err error
+	if sessionName == session.LocalSessionName {
+		sub, replay, seq, err = c.server.sessions.AttachLocal(c.id, uint16(cols), uint16(rows), preferDriver, resumeSeq, record)
+	} else {
+		sub, replay, seq, err = c.server.sessions.Attach(sessionName, c.id, uint16(cols), uint16(rows), preferDriver, resumeSeq, record)
+	}
 	if err != nil {
 		c.sendJSON(ws.ServerMessage{
 			Type:    ws.MsgTypeError,
@@ -181,47 +559,46 @@ func (c *Client) handleAttach(sessionName string, cols, rows int) {
 		return
 	}
 
-	c.attachedSession = sessionName
-	c.pty = ptmx
-	c.cmd = cmd
-	c.stopChan = make(chan struct{})
+	c.setAttached(sessionName, sub)
+	c.server.trackClient(sessionName, c)
 
 	// Notify client
 	c.sendJSON(ws.ServerMessage{
 		Type:    ws.MsgTypeAttached,
 		Session: sessionName,
+		Role:    string(sub.Role()),
 	})
 
-	// Start reading PTY output
-	go c.readPTY()
-}
-
-// handleDetach detaches from the current session
-func (c *Client) handleDetach() {
-	if c.pty == nil {
-		return
-	}
-
-	// Signal stop
-	if c.stopChan != nil {
-		close(c.stopChan)
-		c.stopChan = nil
+	// Replay scrollback (fresh attach) or missed bytes (reconnect), then
+	// mark where live output begins.
+	if len(replay) > 0 {
+		c.sendOutput(seq, replay)
 	}
+	c.sendJSON(ws.ServerMessage{
+		Type: ws.MsgTypeReplayDone,
+		Seq:  seq,
+	})
 
-	// Send detach command to tmux (Ctrl-B d)
-	c.pty.Write([]byte{0x02, 'd'}) // Ctrl-B, d
+	// Start fanning hub output to this client
+	go c.pumpOutput(sub)
 
-	// Close PTY
-	c.pty.Close()
-	c.pty = nil
+	c.server.broadcastRole(sessionName, c.server.sessions.Roster(sessionName))
+}
 
-	// Wait for command to finish
-	if c.cmd != nil {
-		c.cmd.Wait()
-		c.cmd = nil
+// handleDetach leaves the current session's hub. The shared PTY keeps
+// running for any other attached clients; it's only torn down once the
+// last one leaves (see session.Manager.Detach).
+func (c *Client) handleDetach() {
+	sessionName, sub := c.attached()
+	if sub == nil {
+		return
 	}
 
-	c.attachedSession = ""
+	// Clear first, so pumpOutput sees this as a detach rather than the
+	// session ending once Detach closes the subscriber's channel.
+	c.clearIfCurrent(sub)
+	c.server.sessions.Detach(sessionName, c.id)
+	c.server.untrackClient(sessionName, c)
 
 	// Notify client
 	c.sendJSON(ws.ServerMessage{
@@ -230,28 +607,54 @@ func (c *Client) handleDetach() {
 
 	// Send updated session list
 	c.sendSessionList()
+
+	c.server.broadcastRole(sessionName, c.server.sessions.Roster(sessionName))
 }
 
-// handleInput sends input to the PTY
+// handleInput sends input to the PTY, ignoring it unless this client
+// currently holds the driver seat.
 func (c *Client) handleInput(data string) {
-	if c.pty == nil {
+	sessionName, sub := c.attached()
+	if sub == nil {
 		return
 	}
 
-	c.pty.Write([]byte(data))
+	c.server.sessions.Write(sessionName, c.id, []byte(data))
 }
 
-// handleResize resizes the PTY
+// handleResize resizes the shared PTY, ignored unless this client
+// currently holds the driver seat (the shared PTY affects every client
+// attached to the session, so a follower can't resize out from under the
+// driver).
 func (c *Client) handleResize(cols, rows int) {
-	if c.pty == nil {
+	sessionName, sub := c.attached()
+	if sub == nil {
 		return
 	}
 
-	c.server.sessions.Resize(c.pty, uint16(cols), uint16(rows))
+	if err := c.server.sessions.Resize(sessionName, c.id, uint16(cols), uint16(rows)); err == nil {
+		c.sendResize(uint16(cols), uint16(rows))
+	}
 }
 
-// handleCreate creates a new session
-func (c *Client) handleCreate(name string) {
+// handleTakeControl promotes this client to driver for sessionName,
+// demoting whoever held the seat before it.
+func (c *Client) handleTakeControl(sessionName string) {
+	if err := c.server.sessions.TakeControl(sessionName, c.id); err != nil {
+		c.sendJSON(ws.ServerMessage{
+			Type:    ws.MsgTypeError,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	c.server.broadcastRole(sessionName, c.server.sessions.Roster(sessionName))
+}
+
+// handleCreate creates a new session. record starts an asciinema
+// recording of it, teed off the shared hub created by the auto-attach
+// below.
+func (c *Client) handleCreate(name string, record bool) {
 	newName, err := c.server.sessions.Create(name)
 	if err != nil {
 		c.sendJSON(ws.ServerMessage{
@@ -264,14 +667,14 @@ func (c *Client) handleCreate(name string) {
 	// Send updated session list
 	c.sendSessionList()
 
-	// Auto-attach to new session
-	c.handleAttach(newName, 80, 24)
+	// Auto-attach to new session as driver
+	c.handleAttach(newName, 80, 24, true, 0, record)
 }
 
 // handleStop stops a session
 func (c *Client) handleStop(sessionName string) {
 	// Detach if we're attached to this session
-	if c.attachedSession == sessionName {
+	if current, _ := c.attached(); current == sessionName {
 		c.handleDetach()
 	}
 
@@ -287,39 +690,24 @@ func (c *Client) handleStop(sessionName string) {
 	c.sendSessionList()
 }
 
-// readPTY reads output from the PTY and sends to client
-func (c *Client) readPTY() {
-	buf := make([]byte, 4096)
-
-	for {
-		select {
-		case <-c.stopChan:
-			return
-		default:
-		}
-
-		n, err := c.pty.Read(buf)
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("PTY read error: %v", err)
-			}
-			// Session ended, notify client
-			c.sendJSON(ws.ServerMessage{
-				Type: ws.MsgTypeDetached,
-			})
-			c.attachedSession = ""
-			c.pty = nil
-			c.cmd = nil
-			c.sendSessionList()
-			return
-		}
+// pumpOutput relays a hub subscriber's PTY output to this client until
+// this client leaves the hub or the hub shuts down (the PTY process
+// exited).
+func (c *Client) pumpOutput(sub *session.Subscriber) {
+	for chunk := range sub.Output() {
+		c.sendOutput(chunk.Seq, chunk.Data)
+	}
 
-		if n > 0 {
-			c.sendJSON(ws.ServerMessage{
-				Type: ws.MsgTypeOutput,
-				Data: string(buf[:n]),
-			})
-		}
+	// The hub closed out from under us; if we're still marked attached
+	// to it, let the client know the session ended. clearIfCurrent is a
+	// no-op if the client already detached and reattached elsewhere
+	// before this goroutine noticed the channel close.
+	if c.clearIfCurrent(sub) {
+		c.sendFrame(ws.FrameExit)
+		c.sendJSON(ws.ServerMessage{
+			Type: ws.MsgTypeDetached,
+		})
+		c.sendSessionList()
 	}
 }
 
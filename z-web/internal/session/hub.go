@@ -0,0 +1,365 @@
+package session
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/stevemurr/z/z-web/internal/recording"
+	"github.com/stevemurr/z/z-web/internal/ws"
+)
+
+// Bursty programs (find /, yes, a log tail) can produce output faster
+// than once per PTY read; batchWindow and batchMaxBytes bound how long
+// readPump coalesces reads before broadcasting, so a subscriber sees a
+// handful of right-sized chunks instead of thousands of tiny ones.
+const (
+	batchWindow   = 5 * time.Millisecond
+	batchMaxBytes = 16 * 1024
+)
+
+// ringSize is the number of buffered output chunks kept per subscriber
+// before the oldest is dropped to keep a slow consumer from blocking
+// the rest of the session.
+const ringSize = 256
+
+// historyCap is the size of the rolling in-memory PTY output buffer a
+// hub keeps, used to replay only what a client missed after a brief
+// reconnect instead of a full scrollback capture.
+const historyCap = 256 * 1024
+
+// outputChunk is one delivery to a subscriber: the PTY bytes plus the
+// hub's sequence number after those bytes, so a client can remember
+// where to resume from on reconnect.
+type outputChunk struct {
+	Data []byte
+	Seq  int64
+}
+
+// Role describes whether a client may send input to a Hub.
+type Role string
+
+const (
+	RoleDriver   Role = "driver"
+	RoleFollower Role = "follower"
+)
+
+// Subscriber is one client's view into a Hub's PTY stream.
+type Subscriber struct {
+	ID string
+
+	mu   sync.Mutex
+	role Role
+	out  chan outputChunk
+}
+
+// Role returns the subscriber's current role.
+func (s *Subscriber) Role() Role {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.role
+}
+
+// Output returns the channel a client should read PTY output from. It is
+// closed once the hub shuts down.
+func (s *Subscriber) Output() <-chan outputChunk {
+	return s.out
+}
+
+// push delivers data to the subscriber's ring buffer, dropping the
+// oldest queued chunk instead of blocking the hub if the consumer is
+// behind.
+func (s *Subscriber) push(data []byte, seq int64) {
+	chunk := outputChunk{Data: append([]byte(nil), data...), Seq: seq}
+	for {
+		select {
+		case s.out <- chunk:
+			return
+		default:
+		}
+		select {
+		case <-s.out:
+		default:
+		}
+	}
+}
+
+// Hub multiplexes a single PTY across every client attached to one tmux
+// session, so N browser tabs share one `tmux attach-session` instead of
+// each spawning their own.
+type Hub struct {
+	name string
+	ptmx *os.File
+	cmd  *exec.Cmd
+
+	mu         sync.Mutex
+	subs       map[string]*Subscriber
+	driver     *Subscriber
+	closed     bool
+	history    []byte // rolling buffer of the last historyCap bytes of PTY output
+	historySeq int64  // total bytes ever written to history (monotonic)
+
+	rec *recording.Recorder // nil unless this hub's session was created with record:true
+}
+
+// newHub wraps an already-started PTY and begins fanning its output out
+// to subscribers. rec may be nil, if the session isn't being recorded.
+func newHub(name string, ptmx *os.File, cmd *exec.Cmd, rec *recording.Recorder) *Hub {
+	h := &Hub{
+		name: name,
+		ptmx: ptmx,
+		cmd:  cmd,
+		subs: make(map[string]*Subscriber),
+		rec:  rec,
+	}
+	go h.readPump()
+	return h
+}
+
+// readPump copies PTY output to every subscriber until the PTY closes,
+// coalescing reads into a single broadcast until either batchWindow has
+// passed since the batch timer started (at the first read after the
+// previous timer fired) or batchMaxBytes have accumulated.
+func (h *Hub) readPump() {
+	raw := make(chan []byte, 64)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := h.ptmx.Read(buf)
+			if n > 0 {
+				raw <- append([]byte(nil), buf[:n]...)
+			}
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("hub %s: PTY read error: %v", h.name, err)
+				}
+				close(raw)
+				return
+			}
+		}
+	}()
+
+	var pending []byte
+	var timer *time.Timer
+	var timerC <-chan time.Time
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		h.broadcast(pending)
+		pending = nil
+	}
+
+	for {
+		select {
+		case data, ok := <-raw:
+			if !ok {
+				flush()
+				h.Close()
+				return
+			}
+			pending = append(pending, data...)
+			if len(pending) >= batchMaxBytes {
+				flush()
+				continue
+			}
+			if timer == nil {
+				timer = time.NewTimer(batchWindow)
+				timerC = timer.C
+			}
+		case <-timerC:
+			flush()
+			timer = nil
+			timerC = nil
+		}
+	}
+}
+
+func (h *Hub) broadcast(data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.history = append(h.history, data...)
+	h.historySeq += int64(len(data))
+	if len(h.history) > historyCap {
+		h.history = h.history[len(h.history)-historyCap:]
+	}
+
+	for _, sub := range h.subs {
+		sub.push(data, h.historySeq)
+	}
+
+	if h.rec != nil {
+		h.rec.WriteOutput(data)
+	}
+}
+
+// Join attaches id to the hub. If preferDriver is true and no client
+// currently holds the driver seat, id becomes the driver; otherwise it
+// joins as a read-only follower.
+//
+// resumeSeq, if non-zero, is the sequence number the client last saw
+// (e.g. after a brief network drop); Join returns only the bytes
+// produced since then. If resumeSeq is zero or too old to still be in
+// the rolling history window, needsFullReplay is true and the caller
+// should fall back to a fresh tmux capture-pane scrollback dump.
+func (h *Hub) Join(id string, preferDriver bool, resumeSeq int64) (sub *Subscriber, replay []byte, needsFullReplay bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub = &Subscriber{
+		ID:   id,
+		role: RoleFollower,
+		out:  make(chan outputChunk, ringSize),
+	}
+	if preferDriver && h.driver == nil {
+		sub.role = RoleDriver
+		h.driver = sub
+	}
+	h.subs[id] = sub
+
+	base := h.historySeq - int64(len(h.history))
+	if resumeSeq <= 0 || resumeSeq < base || resumeSeq > h.historySeq {
+		needsFullReplay = true
+	} else {
+		replay = append([]byte(nil), h.history[resumeSeq-base:]...)
+	}
+	return sub, replay, needsFullReplay
+}
+
+// Leave removes id from the hub, closing its Output channel so
+// Client.pumpOutput's range loop returns instead of blocking forever on
+// a subscriber the hub no longer knows about. If it held the driver
+// seat, control passes to an arbitrary remaining follower, if any.
+func (h *Hub) Leave(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if sub, ok := h.subs[id]; ok && !h.closed {
+		close(sub.out) // Close already closed it otherwise
+	}
+	delete(h.subs, id)
+	if h.driver != nil && h.driver.ID == id {
+		h.driver = nil
+		for _, sub := range h.subs {
+			sub.mu.Lock()
+			sub.role = RoleDriver
+			sub.mu.Unlock()
+			h.driver = sub
+			break
+		}
+	}
+}
+
+// TakeControl makes id the driver, demoting the previous driver (if any)
+// to follower.
+func (h *Hub) TakeControl(id string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub, ok := h.subs[id]
+	if !ok {
+		return fmt.Errorf("client %q is not attached to session %q", id, h.name)
+	}
+	if h.driver != nil {
+		h.driver.mu.Lock()
+		h.driver.role = RoleFollower
+		h.driver.mu.Unlock()
+	}
+	sub.mu.Lock()
+	sub.role = RoleDriver
+	sub.mu.Unlock()
+	h.driver = sub
+	return nil
+}
+
+// Write sends input to the PTY if id currently holds the driver seat.
+func (h *Hub) Write(id string, data []byte) error {
+	h.mu.Lock()
+	isDriver := h.driver != nil && h.driver.ID == id
+	h.mu.Unlock()
+
+	if !isDriver {
+		return fmt.Errorf("client %q is a follower of session %q", id, h.name)
+	}
+	_, err := h.ptmx.Write(data)
+	return err
+}
+
+// Resize resizes the shared PTY if id currently holds the driver seat.
+// Without this check any follower could resize the one PTY every other
+// client shares, including the driver's.
+func (h *Hub) Resize(id string, cols, rows uint16) error {
+	h.mu.Lock()
+	isDriver := h.driver != nil && h.driver.ID == id
+	h.mu.Unlock()
+
+	if !isDriver {
+		return fmt.Errorf("client %q is a follower of session %q", id, h.name)
+	}
+
+	if err := pty.Setsize(h.ptmx, &pty.Winsize{Rows: rows, Cols: cols}); err != nil {
+		return err
+	}
+	if h.rec != nil {
+		h.rec.WriteResize(cols, rows)
+	}
+	return nil
+}
+
+// Roster returns the roles of every attached client.
+func (h *Hub) Roster() []ws.ClientRole {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	roster := make([]ws.ClientRole, 0, len(h.subs))
+	for id, sub := range h.subs {
+		roster = append(roster, ws.ClientRole{ID: id, Role: string(sub.Role())})
+	}
+	return roster
+}
+
+// RefCount returns the number of clients currently attached.
+func (h *Hub) RefCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// CurrentSeq returns the hub's current output sequence number, i.e. the
+// total bytes of PTY output produced so far.
+func (h *Hub) CurrentSeq() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.historySeq
+}
+
+// Close tears down the PTY and closes every subscriber's output channel.
+// It is safe to call more than once (e.g. once from the read pump
+// noticing PTY EOF, once from the last client detaching).
+func (h *Hub) Close() {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	for _, sub := range h.subs {
+		close(sub.out)
+	}
+	h.mu.Unlock()
+
+	h.ptmx.Close()
+	if h.cmd != nil {
+		h.cmd.Wait()
+	}
+	if h.rec != nil {
+		h.rec.Close()
+	}
+}
@@ -2,83 +2,122 @@ package session
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/creack/pty"
+	"github.com/stevemurr/z/z-web/internal/recording"
 	"github.com/stevemurr/z/z-web/internal/ws"
 )
 
 const (
 	SessionPrefix = "z-"
+
+	// LocalSessionName is the synthetic session name that routes to a
+	// plain local shell (see AttachLocal) instead of a tmux session, for
+	// machines that don't have tmux installed.
+	LocalSessionName = "$local"
+
+	// DefaultScrollbackLines is how much tmux pane history is replayed
+	// to a client on a fresh attach, so the terminal isn't blank until
+	// the user hits Enter.
+	DefaultScrollbackLines = 2000
 )
 
 // Manager handles tmux session operations
 type Manager struct {
-	mu sync.Mutex
+	mu sync.Mutex // serializes tmux CLI invocations
+
+	hubsMu sync.Mutex
+	hubs   map[string]*Hub // session name (without prefix) -> shared PTY hub
+
+	noTmux bool // disable tmux entirely; only AttachLocal works
 }
 
-// NewManager creates a new session manager
-func NewManager() *Manager {
-	return &Manager{}
+// NewManager creates a new session manager. noTmux disables all tmux
+// integration (List, Create, Stop, Attach), for machines that don't have
+// tmux installed; AttachLocal keeps working regardless.
+func NewManager(noTmux bool) *Manager {
+	return &Manager{hubs: make(map[string]*Hub), noTmux: noTmux}
 }
 
-// List returns all z- prefixed tmux sessions
+// List returns all z- prefixed tmux sessions, plus a synthetic entry for
+// the local shell session if one is attached.
 func (m *Manager) List() ([]ws.Session, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Get session list from tmux
-	// Format: session_name|activity_timestamp|attached_clients
-	cmd := exec.Command("tmux", "list-sessions", "-F", "#{session_name}|#{session_activity}|#{session_attached}")
-	output, err := cmd.Output()
-	if err != nil {
-		// No sessions or tmux not running
-		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-			return []ws.Session{}, nil
-		}
-		return nil, fmt.Errorf("failed to list sessions: %w", err)
-	}
-
 	var sessions []ws.Session
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
 
-	for _, line := range lines {
-		if line == "" {
-			continue
+	if !m.noTmux {
+		// Get session list from tmux
+		// Format: session_name|activity_timestamp|attached_clients
+		cmd := exec.Command("tmux", "list-sessions", "-F", "#{session_name}|#{session_activity}|#{session_attached}")
+		output, err := cmd.Output()
+		if err != nil {
+			// No sessions, or tmux isn't installed on this machine
+			if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+				if _, isMissing := err.(*exec.Error); !isMissing {
+					return nil, fmt.Errorf("failed to list sessions: %w", err)
+				}
+			}
+			output = nil
 		}
 
-		parts := strings.Split(line, "|")
-		if len(parts) < 3 {
-			continue
-		}
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
 
-		sessionName := parts[0]
+		for _, line := range lines {
+			if line == "" {
+				continue
+			}
 
-		// Only include z- prefixed sessions
-		if !strings.HasPrefix(sessionName, SessionPrefix) {
-			continue
-		}
+			parts := strings.Split(line, "|")
+			if len(parts) < 3 {
+				continue
+			}
+
+			sessionName := parts[0]
+
+			// Only include z- prefixed sessions
+			if !strings.HasPrefix(sessionName, SessionPrefix) {
+				continue
+			}
 
-		activity, _ := strconv.ParseInt(parts[1], 10, 64)
-		clients, _ := strconv.Atoi(parts[2])
+			activity, _ := strconv.ParseInt(parts[1], 10, 64)
+			clients, _ := strconv.Atoi(parts[2])
 
-		// Get pane info for cwd and command
-		cwd, command := m.getPaneInfo(sessionName)
+			// Get pane info for cwd and command
+			cwd, command := m.getPaneInfo(sessionName)
 
-		// Get git branch
-		branch := m.getGitBranch(cwd)
+			// Get git branch
+			branch := m.getGitBranch(cwd)
 
+			shortName := strings.TrimPrefix(sessionName, SessionPrefix)
+			sessions = append(sessions, ws.Session{
+				Name:     shortName,
+				Cwd:      shortenPath(cwd),
+				Command:  command,
+				Branch:   branch,
+				Activity: activity,
+				Clients:  clients,
+				Roster:   m.Roster(shortName),
+			})
+		}
+	}
+
+	if hub := m.localHub(); hub != nil {
 		sessions = append(sessions, ws.Session{
-			Name:     strings.TrimPrefix(sessionName, SessionPrefix),
-			Cwd:      shortenPath(cwd),
-			Command:  command,
-			Branch:   branch,
-			Activity: activity,
-			Clients:  clients,
+			Name:     LocalSessionName,
+			Command:  "shell",
+			Activity: time.Now().Unix(),
+			Clients:  hub.RefCount(),
+			Roster:   hub.Roster(),
 		})
 	}
 
@@ -121,6 +160,10 @@ func (m *Manager) getGitBranch(dir string) string {
 
 // Create creates a new tmux session
 func (m *Manager) Create(name string) (string, error) {
+	if m.noTmux {
+		return "", fmt.Errorf("tmux support is disabled (--no-tmux); use the local shell session instead")
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -149,6 +192,10 @@ func (m *Manager) Create(name string) (string, error) {
 
 // Stop stops a tmux session
 func (m *Manager) Stop(name string) error {
+	if m.noTmux {
+		return fmt.Errorf("tmux support is disabled (--no-tmux)")
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -162,40 +209,221 @@ func (m *Manager) Stop(name string) error {
 	return nil
 }
 
-// Attach returns a PTY attached to the tmux session
-func (m *Manager) Attach(name string, cols, rows uint16) (*os.File, *exec.Cmd, error) {
+// Attach joins clientID to the shared PTY hub for name, spawning a single
+// `tmux attach-session` the first time anyone attaches. Later callers for
+// the same session reuse that hub instead of spawning their own attach,
+// so multiple browser tabs can watch or drive the same terminal. The
+// first client to attach becomes the driver when preferDriver is set;
+// later joiners (or followers that pass preferDriver=false) are
+// read-only until they TakeControl.
+//
+// resumeSeq lets a reconnecting client ask for only the bytes it missed
+// since sequence number resumeSeq; pass 0 for a fresh attach. replay is
+// the scrollback to show the client before live output starts, and seq
+// is the hub's current sequence number once the client is caught up.
+//
+// record only takes effect the first time a session's hub is created
+// (typically right after Create, via an auto-attach); it's ignored when
+// joining a hub that already exists.
+func (m *Manager) Attach(name, clientID string, cols, rows uint16, preferDriver bool, resumeSeq int64, record bool) (sub *Subscriber, replay []byte, seq int64, err error) {
+	if m.noTmux {
+		return nil, nil, 0, fmt.Errorf("tmux support is disabled (--no-tmux); use the local shell session instead")
+	}
+
+	m.hubsMu.Lock()
+	defer m.hubsMu.Unlock()
+
 	sessionName := SessionPrefix + name
 
-	// Verify session exists
-	checkCmd := exec.Command("tmux", "has-session", "-t", sessionName)
-	if err := checkCmd.Run(); err != nil {
-		return nil, nil, fmt.Errorf("session '%s' not found", name)
+	hub, ok := m.hubs[name]
+	if !ok {
+		checkCmd := exec.Command("tmux", "has-session", "-t", sessionName)
+		if err := checkCmd.Run(); err != nil {
+			return nil, nil, 0, fmt.Errorf("session '%s' not found", name)
+		}
+
+		cmd := exec.Command("tmux", "attach-session", "-t", sessionName)
+		cmd.Env = append(os.Environ(),
+			fmt.Sprintf("TERM=xterm-256color"),
+		)
+
+		ptmx, startErr := pty.StartWithSize(cmd, &pty.Winsize{
+			Rows: rows,
+			Cols: cols,
+		})
+		if startErr != nil {
+			return nil, nil, 0, fmt.Errorf("failed to attach: %w", startErr)
+		}
+
+		hub = newHub(name, ptmx, cmd, newRecorderIfRequested(record, name, cols, rows))
+		m.hubs[name] = hub
+	}
+
+	sub, replay, needsFullReplay := hub.Join(clientID, preferDriver, resumeSeq)
+	if needsFullReplay {
+		if captured, captureErr := captureScrollback(sessionName, DefaultScrollbackLines); captureErr == nil {
+			replay = captured
+		}
+		// A failed capture isn't fatal to attaching; the client just
+		// starts with a blank terminal instead of replayed scrollback.
+	}
+
+	return sub, replay, hub.CurrentSeq(), nil
+}
+
+// AttachLocal joins clientID to the shared PTY hub for a plain login
+// shell, spawned the first time anyone attaches. It's the tmux-free
+// counterpart to Attach, for machines that don't have tmux installed (or
+// were started with --no-tmux): instead of `tmux attach-session`, it
+// starts $SHELL as a login shell directly. The shared hub, driver/follower
+// roles and resume by seq work as in Attach; when a full replay would be
+// needed there is no pane to capture, so replay is empty.
+func (m *Manager) AttachLocal(clientID string, cols, rows uint16, preferDriver bool, resumeSeq int64, record bool) (sub *Subscriber, replay []byte, seq int64, err error) {
+	m.hubsMu.Lock()
+	defer m.hubsMu.Unlock()
+
+	hub, ok := m.hubs[LocalSessionName]
+	if !ok {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+
+		cmd := exec.Command(shell, "-l")
+		cmd.Env = append(os.Environ(),
+			fmt.Sprintf("TERM=xterm-256color"),
+		)
+
+		ptmx, startErr := pty.StartWithSize(cmd, &pty.Winsize{
+			Rows: rows,
+			Cols: cols,
+		})
+		if startErr != nil {
+			return nil, nil, 0, fmt.Errorf("failed to start local shell: %w", startErr)
+		}
+
+		hub = newHub(LocalSessionName, ptmx, cmd, newRecorderIfRequested(record, LocalSessionName, cols, rows))
+		m.hubs[LocalSessionName] = hub
 	}
 
-	// Attach to session via PTY
-	cmd := exec.Command("tmux", "attach-session", "-t", sessionName)
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("TERM=xterm-256color"),
-	)
+	sub, replay, _ = hub.Join(clientID, preferDriver, resumeSeq)
+	return sub, replay, hub.CurrentSeq(), nil
+}
 
-	// Start with PTY
-	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{
-		Rows: rows,
-		Cols: cols,
-	})
+// localHub returns the local shell hub, or nil if nobody has attached to
+// it yet. Callers must not already hold hubsMu.
+func (m *Manager) localHub() *Hub {
+	m.hubsMu.Lock()
+	defer m.hubsMu.Unlock()
+	return m.hubs[LocalSessionName]
+}
+
+// newRecorderIfRequested starts an asciinema recording for a freshly
+// created hub, if requested. A failure to start recording isn't fatal to
+// attaching; the session just isn't recorded.
+func newRecorderIfRequested(record bool, name string, cols, rows uint16) *recording.Recorder {
+	if !record {
+		return nil
+	}
+	rec, err := recording.New(name, cols, rows)
+	if err != nil {
+		log.Printf("session %s: failed to start recording: %v", name, err)
+		return nil
+	}
+	return rec
+}
+
+// captureScrollback returns the last `lines` of a tmux pane's history,
+// including escape sequences, for replay into a fresh terminal.
+func captureScrollback(sessionName string, lines int) ([]byte, error) {
+	cmd := exec.Command("tmux", "capture-pane", "-t", sessionName, "-p", "-e", "-S", fmt.Sprintf("-%d", lines))
+	output, err := cmd.Output()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to attach: %w", err)
+		return nil, fmt.Errorf("failed to capture scrollback: %w", err)
 	}
+	return output, nil
+}
+
+// Detach removes clientID from the session's hub. Only when the last
+// client leaves is the underlying tmux client actually detached and the
+// PTY closed; other clients keep watching or driving uninterrupted.
+//
+// hubsMu is held across the whole leave-check-delete sequence, not just
+// the map lookup: releasing it between the RefCount check and the delete
+// would let Attach join the same hub in that window, only for this call
+// to then close the PTY out from under the client that just joined.
+func (m *Manager) Detach(name, clientID string) {
+	m.hubsMu.Lock()
+	defer m.hubsMu.Unlock()
+
+	hub, ok := m.hubs[name]
+	if !ok {
+		return
+	}
+
+	hub.Leave(clientID)
+
+	if hub.RefCount() == 0 {
+		delete(m.hubs, name)
 
-	return ptmx, cmd, nil
+		if name == LocalSessionName {
+			// There's no tmux client to detach from; just end the shell.
+			if hub.cmd.Process != nil {
+				hub.cmd.Process.Signal(syscall.SIGHUP)
+			}
+		} else {
+			hub.ptmx.Write([]byte{0x02, 'd'}) // Ctrl-B, d: detach the tmux client
+		}
+		hub.Close()
+	}
 }
 
-// Resize resizes the PTY
-func (m *Manager) Resize(ptmx *os.File, cols, rows uint16) error {
-	return pty.Setsize(ptmx, &pty.Winsize{
-		Rows: rows,
-		Cols: cols,
-	})
+// TakeControl promotes clientID to driver for the session it is
+// attached to, demoting whoever held the seat before it.
+func (m *Manager) TakeControl(name, clientID string) error {
+	m.hubsMu.Lock()
+	hub, ok := m.hubs[name]
+	m.hubsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("session '%s' has no attached clients", name)
+	}
+	return hub.TakeControl(clientID)
+}
+
+// Write sends input to the session's PTY, rejecting it unless clientID
+// currently holds the driver seat.
+func (m *Manager) Write(name, clientID string, data []byte) error {
+	m.hubsMu.Lock()
+	hub, ok := m.hubs[name]
+	m.hubsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("session '%s' has no attached clients", name)
+	}
+	return hub.Write(clientID, data)
+}
+
+// Resize resizes the shared PTY for a session, rejecting it unless
+// clientID currently holds the driver seat.
+func (m *Manager) Resize(name, clientID string, cols, rows uint16) error {
+	m.hubsMu.Lock()
+	hub, ok := m.hubs[name]
+	m.hubsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("session '%s' has no attached clients", name)
+	}
+	return hub.Resize(clientID, cols, rows)
+}
+
+// Roster returns the z-web clients currently sharing name, or nil if
+// nobody has attached through a hub.
+func (m *Manager) Roster(name string) []ws.ClientRole {
+	m.hubsMu.Lock()
+	hub, ok := m.hubs[name]
+	m.hubsMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return hub.Roster()
 }
 
 // shortenPath shortens a path for display
@@ -4,47 +4,94 @@ package ws
 type ClientMessage struct {
 	Type    string `json:"type"`
 	Data    string `json:"data,omitempty"`    // For input
-	Session string `json:"session,omitempty"` // For attach/stop
+	Session string `json:"session,omitempty"` // For attach/stop/takeControl
 	Name    string `json:"name,omitempty"`    // For create
 	Cols    int    `json:"cols,omitempty"`    // For resize
 	Rows    int    `json:"rows,omitempty"`    // For resize
+	Seq     int64  `json:"seq,omitempty"`     // For attach: last output seq the client already has, to resume a drop
+	Record  bool   `json:"record,omitempty"`  // For create: tee the session's PTY output to an asciinema recording
 }
 
 // Message types from client
 const (
-	MsgTypeInput   = "input"   // Terminal input
-	MsgTypeResize  = "resize"  // Terminal resize
-	MsgTypeAttach  = "attach"  // Attach to session
-	MsgTypeDetach  = "detach"  // Detach from session
-	MsgTypeList    = "list"    // List sessions
-	MsgTypeCreate  = "create"  // Create new session
-	MsgTypeStop    = "stop"    // Stop session
+	MsgTypeInput       = "input"       // Terminal input
+	MsgTypeResize      = "resize"      // Terminal resize
+	MsgTypeAttach      = "attach"      // Attach to session (driver if none yet)
+	MsgTypeDetach      = "detach"      // Detach from session
+	MsgTypeList        = "list"        // List sessions
+	MsgTypeCreate      = "create"      // Create new session
+	MsgTypeStop        = "stop"        // Stop session
+	MsgTypeFollow      = "follow"      // Join a session as a read-only observer
+	MsgTypeUnfollow    = "unfollow"    // Leave observer mode
+	MsgTypeTakeControl = "takeControl" // Request the driver seat
+	MsgTypePeers       = "peers"       // Request the tailnet peer roster
 )
 
-// ServerMessage represents messages to the browser
+// ServerMessage represents control messages to the browser. PTY output
+// no longer travels over this envelope; see FrameOutput below.
 type ServerMessage struct {
-	Type     string    `json:"type"`
-	Data     string    `json:"data,omitempty"`     // For output (base64)
-	Session  string    `json:"session,omitempty"`  // For attached
-	Sessions []Session `json:"sessions,omitempty"` // For sessions list
-	Message  string    `json:"message,omitempty"`  // For error
+	Type     string       `json:"type"`
+	Session  string       `json:"session,omitempty"`  // For attached/role
+	Sessions []Session    `json:"sessions,omitempty"` // For sessions list
+	Message  string       `json:"message,omitempty"`  // For error
+	Role     string       `json:"role,omitempty"`     // For attached/role
+	Roster   []ClientRole `json:"roster,omitempty"`   // For role
+	Seq      int64        `json:"seq,omitempty"`      // For replayDone: hub sequence number after the replay
+	Peers    []Peer       `json:"peers,omitempty"`    // For peers
 }
 
 // Message types to client
 const (
-	MsgTypeOutput   = "output"   // Terminal output
-	MsgTypeSessions = "sessions" // Session list
-	MsgTypeAttached = "attached" // Attached to session
-	MsgTypeDetached = "detached" // Detached from session
-	MsgTypeError    = "error"    // Error message
+	MsgTypeSessions   = "sessions"   // Session list
+	MsgTypeAttached   = "attached"   // Attached to session
+	MsgTypeDetached   = "detached"   // Detached from session
+	MsgTypeError      = "error"      // Error message
+	MsgTypeRole       = "role"       // Driver/follower roster changed
+	MsgTypeReplayDone = "replayDone" // Scrollback/resume replay finished; live output follows
 )
 
+// Binary WebSocket frame types. PTY output is latency- and
+// throughput-sensitive (bursty TUIs can produce megabytes of output per
+// second), so it bypasses the JSON ServerMessage envelope entirely: each
+// frame is a 1-byte type prefix followed by a type-specific payload. JSON
+// is still used for control messages (attach, sessions, error, role, ...).
+const (
+	FrameOutput    byte = 0x01 // 8-byte big-endian hub sequence number, then raw PTY output bytes
+	FrameResizeAck byte = 0x02 // resize applied; payload is cols,rows as two big-endian uint16s
+	FrameExit      byte = 0x03 // PTY process exited; no payload
+)
+
+// ClientRole is one entry in a session's client roster.
+type ClientRole struct {
+	ID   string `json:"id"`
+	Role string `json:"role"` // "driver" or "follower"
+}
+
+// Peer is another z-web instance discovered elsewhere in the tailnet.
+type Peer struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	TailscaleIP string `json:"tailscale_ip"`
+	LastSeen    int64  `json:"last_seen"` // Unix timestamp of the last successful beacon probe
+}
+
 // Session represents a z term session
 type Session struct {
-	Name     string `json:"name"`
-	Cwd      string `json:"cwd"`
-	Command  string `json:"command"`
-	Branch   string `json:"branch,omitempty"`
-	Activity int64  `json:"activity"` // Unix timestamp
-	Clients  int    `json:"clients"`
+	Name     string       `json:"name"`
+	Cwd      string       `json:"cwd"`
+	Command  string       `json:"command"`
+	Branch   string       `json:"branch,omitempty"`
+	Activity int64        `json:"activity"` // Unix timestamp
+	Clients  int          `json:"clients"`
+	Roster   []ClientRole `json:"roster,omitempty"` // z-web clients sharing this session
+}
+
+// Recording describes one asciinema recording on disk, for the
+// /api/recordings list endpoint.
+type Recording struct {
+	ID        string  `json:"id"`      // filename without the .cast extension
+	Session   string  `json:"session"` // name of the session that was recorded
+	StartedAt int64   `json:"started_at"`
+	Duration  float64 `json:"duration"` // seconds, from the start of the recording to its last event
+	Size      int64   `json:"size"`     // bytes on disk
 }